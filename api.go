@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// writeJSON encodes v as the response body, failing the request if encoding
+// errors rather than leaving a half-written body.
+func (k *Krud) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		k.serveError(w, err)
+	}
+}
+
+// apiListHooks serves GET /api/hooks.
+func (k *Krud) apiListHooks(w http.ResponseWriter, r *http.Request) {
+	hooks, err := k.Store.List()
+	if err != nil {
+		k.serveError(w, err)
+		return
+	}
+	k.writeJSON(w, hooks)
+}
+
+// apiHookByID serves GET /api/hooks/{id} and POST /api/hooks/{id}/retry. The
+// stdlib mux used elsewhere in this package has no path-parameter support,
+// so the id is pulled out by hand.
+func (k *Krud) apiHookByID(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/hooks/")
+	id, action := rest, ""
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		id, action = rest[:i], rest[i+1:]
+	}
+	if id == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	h, err := k.Store.Get(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	switch action {
+	case "":
+		k.writeJSON(w, h)
+	case "retry":
+		if r.Method != http.MethodPost {
+			http.Error(w, "retry requires POST", http.StatusMethodNotAllowed)
+			return
+		}
+		queueDepth.Inc()
+		go func() {
+			k.Next <- h
+		}()
+		k.writeJSON(w, h)
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Event is a single rollout status update, tagged with the webhook it
+// belongs to so a client watching several in-flight updates can tell them
+// apart.
+type Event struct {
+	HookID string `json:"hook_id"`
+	Type   string `json:"type"`
+	Data   string `json:"data"`
+}
+
+// eventBroadcaster fans Events out to any number of subscribers, dropping
+// rather than blocking if a subscriber falls behind, since status is only
+// ever informational.
+type eventBroadcaster struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+func newEventBroadcaster() *eventBroadcaster {
+	return &eventBroadcaster{subs: make(map[chan Event]struct{})}
+}
+
+func (b *eventBroadcaster) subscribe() chan Event {
+	ch := make(chan Event, 16)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *eventBroadcaster) unsubscribe(ch chan Event) {
+	b.mu.Lock()
+	delete(b.subs, ch)
+	b.mu.Unlock()
+	close(ch)
+}
+
+func (b *eventBroadcaster) publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// publish records a lifecycle or progress event for h.
+func (k *Krud) publish(h *Webhook, typ, data string) {
+	k.Events.publish(Event{HookID: h.ID, Type: typ, Data: data})
+}
+
+// serveEvents streams Events to the client as Server-Sent Events, so the
+// view can fill in rollout status live instead of on refresh.
+func (k *Krud) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	ch := k.Events.subscribe()
+	defer k.Events.unsubscribe(ch)
+
+	for {
+		select {
+		case e := <-ch:
+			b, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", e.HookID, e.Type, b)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+var wsUpgrader = websocket.Upgrader{
+	// Webhook senders and browsers hitting / are never cross-origin in a
+	// krud deployment, which typically sits behind its own ingress.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// serveWS is the WebSocket equivalent of serveEvents, for clients that would
+// rather not use EventSource.
+func (k *Krud) serveWS(w http.ResponseWriter, r *http.Request) {
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	ch := k.Events.subscribe()
+	defer k.Events.unsubscribe(ch)
+
+	for e := range ch {
+		if err := conn.WriteJSON(e); err != nil {
+			return
+		}
+	}
+}
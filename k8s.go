@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/homedir"
+
+	legacyclient "k8s.io/kubernetes/pkg/client"
+)
+
+// buildRestConfig resolves a client config the same way kubectl does: an
+// explicit --kubeconfig first, then in-cluster config, then $HOME/.kube/config
+// as a last resort for running krud outside the cluster during development.
+func buildRestConfig(kubeconfig string) (*rest.Config, error) {
+	if kubeconfig != "" {
+		return clientcmd.BuildConfigFromFlags("", kubeconfig)
+	}
+	if cfg, err := rest.InClusterConfig(); err == nil {
+		return cfg, nil
+	}
+	if home := homedir.HomeDir(); home != "" {
+		if cfg, err := clientcmd.BuildConfigFromFlags("", filepath.Join(home, ".kube", "config")); err == nil {
+			return cfg, nil
+		}
+	}
+	return nil, fmt.Errorf("unable to find a kubeconfig: pass --kubeconfig, run in-cluster, or set up $HOME/.kube/config")
+}
+
+// startInformers starts a shared informer for whichever resource ResourceKind
+// selects and blocks until its cache has synced, so currentImage never races
+// an empty lister.
+func (k *Krud) startInformers() error {
+	factory := informers.NewSharedInformerFactoryWithOptions(k.Client, 0, informers.WithNamespace(k.namespaceOrDefault()))
+	stop := make(chan struct{})
+
+	var hasSynced cache.InformerSynced
+	switch k.ResourceKind {
+	case "deployment":
+		informer := factory.Apps().V1().Deployments()
+		k.deploymentLister = informer.Lister()
+		hasSynced = informer.Informer().HasSynced
+	case "statefulset":
+		informer := factory.Apps().V1().StatefulSets()
+		k.statefulSetLister = informer.Lister()
+		hasSynced = informer.Informer().HasSynced
+	default:
+		informer := factory.Core().V1().ReplicationControllers()
+		k.rcLister = informer.Lister()
+		hasSynced = informer.Informer().HasSynced
+	}
+
+	factory.Start(stop)
+	if !cache.WaitForCacheSync(stop, hasSynced) {
+		return fmt.Errorf("failed to sync %s informer cache", k.ResourceKind)
+	}
+	return nil
+}
+
+func (k *Krud) namespaceOrDefault() string {
+	if k.Namespace == "" {
+		return v1.NamespaceDefault
+	}
+	return k.Namespace
+}
+
+// newLegacyClient builds a client against the pre-client-go "pkg/client"
+// package that kubectl.RollingUpdater still requires for the "rc" resource
+// kind, bridging the resolved rest.Config instead of hard-coding an endpoint.
+// It's built once at startup and held on Krud, the same as Client, rather
+// than reconstructed per webhook.
+func newLegacyClient(restConfig *rest.Config) (*legacyclient.Client, error) {
+	return legacyclient.New(&legacyclient.Config{
+		Host:        restConfig.Host,
+		BearerToken: restConfig.BearerToken,
+	})
+}
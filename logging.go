@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// newLogger builds a structured logger from --log-level and --log-format,
+// replacing the ad-hoc log.Println/fmt.Println calls this package used to
+// make directly.
+func newLogger(level, format string) (*zap.SugaredLogger, error) {
+	var lvl zapcore.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("--log-level: %v", err)
+	}
+
+	var cfg zap.Config
+	switch format {
+	case "json":
+		cfg = zap.NewProductionConfig()
+	case "console":
+		cfg = zap.NewDevelopmentConfig()
+	default:
+		return nil, fmt.Errorf("--log-format must be json or console")
+	}
+	cfg.Level = zap.NewAtomicLevelAt(lvl)
+
+	logger, err := cfg.Build()
+	if err != nil {
+		return nil, err
+	}
+	return logger.Sugar(), nil
+}
@@ -5,18 +5,22 @@ import (
 	"flag"
 	"fmt"
 	"html/template"
-	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/coreos/pkg/flagutil"
-	"k8s.io/kubernetes/pkg/api"
-	"k8s.io/kubernetes/pkg/client"
-	"k8s.io/kubernetes/pkg/kubectl"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	legacyclient "k8s.io/kubernetes/pkg/client"
 )
 
 func main() {
@@ -25,7 +29,23 @@ func main() {
 	deploymentKey := fs.String("deployment-key", "deployment", "Key to use to differentiate between two different controllers.")
 	controllerName := fs.String("controller-name", "", "Name of the replication controller to update.")
 	namespace := fs.String("namespace", "", "Namespace the replicationController belongs to.")
-	k8sEndpoint := fs.String("k8s-endpoint", "http://localhost:8080", "URL of the Kubernetes API server")
+	kubeconfig := fs.String("kubeconfig", "", "Path to a kubeconfig file. If unset, in-cluster config is used.")
+	webhookSecret := fs.String("webhook-secret", "", "Shared secret required to authenticate incoming webhooks, used as a fallback for any source without its own secret flag.")
+	quaySecret := fs.String("quay-secret", "", "Token Quay.io must present in its Authorization header. Falls back to --webhook-secret.")
+	dockerhubToken := fs.String("dockerhub-token", "", "Token Docker Hub must present as a ?token= query parameter. Falls back to --webhook-secret.")
+	githubSecret := fs.String("github-secret", "", "Secret GitHub's webhook is configured with; verified against the X-Hub-Signature-256 HMAC. Falls back to --webhook-secret.")
+	gitlabToken := fs.String("gitlab-token", "", "Token GitLab's webhook is configured with, presented in X-Gitlab-Token. Falls back to --webhook-secret.")
+	resourceKind := fs.String("resource-kind", "rc", "Kind of resource to roll: rc, deployment, or statefulset.")
+	updatePeriod := fs.Duration("update-period", 3*time.Second, "Time to wait between stepping an rc rollout forward. Deployment and statefulset rollouts are watched until complete and ignore this.")
+	timeout := fs.Duration("timeout", 5*time.Minute, "Time to wait for a rollout to become ready. A deployment or statefulset that times out is rolled back; an rc is not.")
+	maxSurge := fs.String("max-surge", "25%", "Max number of pods that can be scheduled above the desired count during a deployment rollout. Statefulsets have no surge concept and ignore this.")
+	maxUnavailable := fs.String("max-unavailable", "25%", "Max number of pods that can be unavailable during a deployment/statefulset rollout.")
+	store := fs.String("store", "memory", "Hook history backend: memory, bolt, or configmap.")
+	maxHistory := fs.Int("max-history", 100, "Maximum number of webhooks to retain in history. 0 means unlimited.")
+	historyPath := fs.String("history-path", "krud-hooks.db", "Path to the BoltDB file used by --store=bolt.")
+	historyConfigMap := fs.String("history-configmap", "krud-hooks", "Name of the ConfigMap used by --store=configmap, in --namespace.")
+	logLevel := fs.String("log-level", "info", "Log level: debug, info, warn, or error.")
+	logFormat := fs.String("log-format", "json", "Log output format: json or console.")
 
 	if err := fs.Parse(os.Args[1:]); err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
@@ -37,30 +57,142 @@ func main() {
 		os.Exit(1)
 	}
 
+	logger, err := newLogger(*logLevel, *logFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	defer logger.Sync()
+
 	if *deploymentKey == "" || *controllerName == "" {
-		panic("missing deployment key or controller name")
+		logger.Fatal("missing deployment key or controller name")
+	}
+	switch *resourceKind {
+	case "rc", "deployment", "statefulset":
+	default:
+		logger.Fatal("--resource-kind must be one of rc, deployment, statefulset")
+	}
+
+	restConfig, err := buildRestConfig(*kubeconfig)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	legacyClient, err := newLegacyClient(restConfig)
+	if err != nil {
+		logger.Fatal(err)
 	}
 
 	k := &Krud{
 		DeploymentKey:  *deploymentKey,
 		ControllerName: *controllerName,
-		Endpoint:       *k8sEndpoint,
 		Namespace:      *namespace,
+		WebhookSecret:  *webhookSecret,
+		QuaySecret:     *quaySecret,
+		DockerHubToken: *dockerhubToken,
+		GithubSecret:   *githubSecret,
+		GitLabToken:    *gitlabToken,
+		ResourceKind:   *resourceKind,
+		UpdatePeriod:   *updatePeriod,
+		Timeout:        *timeout,
+		MaxSurge:       *maxSurge,
+		MaxUnavailable: *maxUnavailable,
+		RestConfig:     restConfig,
+		Client:         clientset,
+		LegacyClient:   legacyClient,
+		Events:         newEventBroadcaster(),
+		Log:            logger.With("controller", *controllerName, "namespace", *namespace),
+	}
+	if err := k.startInformers(); err != nil {
+		k.Log.Fatal(err)
+	}
+	hookStore, err := newHookStore(*store, *maxHistory, *historyPath, *historyConfigMap, k)
+	if err != nil {
+		k.Log.Fatal(err)
 	}
+	k.Store = hookStore
 
 	http.HandleFunc("/push", k.push)
 	http.HandleFunc("/", k.view)
-	log.Fatal(k.listen(*listen))
+	http.HandleFunc("/api/hooks", k.apiListHooks)
+	http.HandleFunc("/api/hooks/", k.apiHookByID)
+	http.HandleFunc("/events", k.serveEvents)
+	http.HandleFunc("/ws", k.serveWS)
+	http.Handle("/metrics", promhttp.Handler())
+	k.Log.Fatal(k.listen(*listen))
 }
 
 type Krud struct {
 	DeploymentKey  string
 	ControllerName string
 	Namespace      string
-	Endpoint       string
 
-	// Hooks contains all incoming webhooks
-	Hooks []*Webhook
+	// RestConfig is the resolved Kubernetes client config (in-cluster or
+	// --kubeconfig), kept around so legacy-client codepaths can be built from
+	// it without re-resolving auth.
+	RestConfig *rest.Config
+	// Client is the long-lived Kubernetes client, constructed once at
+	// startup instead of per webhook.
+	Client kubernetes.Interface
+	// LegacyClient is the pre-client-go client kubectl.RollingUpdater needs
+	// for the "rc" resource kind, built once alongside Client.
+	LegacyClient *legacyclient.Client
+
+	// rcLister, deploymentLister and statefulSetLister are informer-backed
+	// caches for whichever resource ResourceKind selects; only the relevant
+	// one is populated. currentImage reads through them instead of hitting
+	// the API server on every webhook.
+	rcLister          corelisters.ReplicationControllerLister
+	deploymentLister  appslisters.DeploymentLister
+	statefulSetLister appslisters.StatefulSetLister
+
+	// WebhookSecret is the fallback shared secret for sources without their
+	// own secret flag. A source whose secret (specific or fallback) is empty
+	// will have all of its webhooks rejected.
+	WebhookSecret string
+	// QuaySecret is the token Quay.io must present in its Authorization header.
+	QuaySecret string
+	// DockerHubToken is the token Docker Hub must present as a ?token= query
+	// parameter, since Docker Hub webhooks carry no custom headers.
+	DockerHubToken string
+	// GithubSecret is the secret GitHub's webhook is configured with. It's
+	// never sent on the wire; instead it's used to verify the
+	// X-Hub-Signature-256 HMAC GitHub computes over the request body.
+	GithubSecret string
+	// GitLabToken is the shared secret GitLab's webhook is configured with,
+	// presented verbatim in the X-Gitlab-Token header.
+	GitLabToken string
+
+	// ResourceKind selects which controller type to roll: "rc" (the
+	// default), "deployment", or "statefulset".
+	ResourceKind string
+	// UpdatePeriod is how long to wait between steps of an rc rollout.
+	// Deployment and StatefulSet rollouts are watched until complete and do
+	// not use it.
+	UpdatePeriod time.Duration
+	// Timeout is how long to wait for a rollout to become ready. A Deployment
+	// or StatefulSet that times out is rolled back to its prior images; an rc
+	// rollout that times out is not rolled back.
+	Timeout time.Duration
+	// MaxSurge and MaxUnavailable bound a rollout, as an absolute count or a
+	// percentage (e.g. "25%"), same as kubectl. MaxSurge only applies to
+	// Deployments; StatefulSets have no surge concept and only use
+	// MaxUnavailable.
+	MaxSurge       string
+	MaxUnavailable string
+
+	// Store holds the history of received webhooks, bounded and durable
+	// according to whichever backend --store selects.
+	Store HookStore
+	// Events fans out rollout lifecycle and progress updates to /events and
+	// /ws subscribers as they happen.
+	Events *eventBroadcaster
+	// Log is this Krud's structured logger, pre-populated with the
+	// controller/namespace fields so every line it writes is attributable.
+	Log *zap.SugaredLogger
 	// Next is the next-to-update webhook, nil for none. Multiple attempts will
 	// use the most recently received hook.
 	Next chan *Webhook
@@ -71,17 +203,19 @@ type Krud struct {
 func (k *Krud) listen(listen string) error {
 	k.Next = make(chan *Webhook)
 	go k.start()
-	log.Println("serving on", listen)
+	k.Log.Infow("serving", "addr", listen)
 	return http.ListenAndServe(listen, nil)
 }
 
 func (k *Krud) start() {
 	for {
 		h := <-k.Next
+		queueDepth.Dec()
 	Loop:
 		for {
 			select {
 			case c := <-k.Next:
+				queueDepth.Dec()
 				if h.Received.Before(c.Received) {
 					h = c
 				}
@@ -91,18 +225,43 @@ func (k *Krud) start() {
 		}
 		if err := k.update(h); err != nil {
 			k.Lock()
-			h.UpdateError = err
+			h.UpdateError = err.Error()
 			k.Unlock()
+			k.saveHook(h)
 		}
 	}
 }
 
+// saveHook persists h's current state to the store, logging rather than
+// failing the update on a storage error.
+func (k *Krud) saveHook(h *Webhook) {
+	if err := k.Store.Save(h); err != nil {
+		k.Log.Errorw("saving webhook history", "webhook_id", h.ID, "error", err)
+	}
+}
+
 type Webhook struct {
+	// ID uniquely identifies this webhook in the store; it's the time it was
+	// received as a fixed-width UnixNano string, so it also sorts
+	// chronologically.
+	ID       string
 	Data     interface{}
 	Kind     string
 	Source   string
 	Received time.Time
 
+	// Verified is true if the webhook's signature/token passed the check for
+	// its source. Unverified webhooks are rejected in push and never reach
+	// this point, so this is always true for a hook present in the store; it
+	// is kept on the struct so the view can say so explicitly.
+	Verified bool
+
+	// ImageRepo and ImageTag are the repository and tag the webhook's
+	// provider says were pushed, used to patch Deployment/StatefulSet
+	// container images and to skip unrelated tags.
+	ImageRepo string
+	ImageTag  string
+
 	// UpdateAttempt is set if an update was started for this hook.
 	UpdateAttempt bool
 	// UpdateID is the ID of this update, which is what the value of the deployment
@@ -112,54 +271,22 @@ type Webhook struct {
 	UpdateSuccess bool
 	UpdateStart   time.Time
 	UpdateEnd     time.Time
-	UpdateStatus  string
-	UpdateError   error
+	// RolledBack is true if the update failed to become ready within Timeout
+	// and was automatically rolled back to its prior revision.
+	RolledBack   bool
+	UpdateStatus string
+	// UpdateError is err.Error() of the update failure, if any. It's stored
+	// as a string rather than the bare error interface because error has no
+	// exported fields for encoding/json to round-trip, and a store like
+	// boltStore or configMapStore has to survive exactly that.
+	UpdateError string
 }
 
-func serveError(w http.ResponseWriter, err error) {
-	log.Println(err)
+func (k *Krud) serveError(w http.ResponseWriter, err error) {
+	k.Log.Error(err)
 	http.Error(w, err.Error(), http.StatusInternalServerError)
 }
 
-type QuayWebhook struct {
-	DockerURL        string `json:"docker_url"`
-	Homepage         string
-	Name             string
-	Namespace        string
-	PrunedImageCount int `json:"pruned_image_count"`
-	PushedImageCount int `json:"pushed_image_count"`
-	Repository       string
-	UpdatedTags      struct {
-		Latest string
-	} `json:"updated_tags"`
-	Visibility string
-}
-
-type DockerWebhook struct {
-	CallbackURL string `json:"callback_url"`
-	PushData    struct {
-		Images   interface{} `json:"images"`
-		PushedAt int         `json:"pushed_at"`
-		Pusher   string      `json:"pusher"`
-	} `json:"push_data"`
-	Repository struct {
-		CommentCount    int    `json:"comment_count"`
-		DateCreated     int    `json:"date_created"`
-		Description     string `json:"description"`
-		FullDescription string `json:"full_description"`
-		IsOfficial      bool   `json:"is_official"`
-		IsPrivate       bool   `json:"is_private"`
-		IsTrusted       bool   `json:"is_trusted"`
-		Name            string `json:"name"`
-		Namespace       string `json:"namespace"`
-		Owner           string `json:"owner"`
-		RepoName        string `json:"repo_name"`
-		RepoURL         string `json:"repo_url"`
-		StarCount       int    `json:"star_count"`
-		Status          string `json:"status"`
-	} `json:"repository"`
-}
-
 var (
 	viewFuncs = template.FuncMap{
 		"json": func(v interface{}) (string, error) {
@@ -171,128 +298,124 @@ var (
 )
 
 func (k *Krud) view(w http.ResponseWriter, r *http.Request) {
-	k.Lock()
-	defer k.Unlock()
-	err := viewTemplate.Execute(w, k)
+	hooks, err := k.Store.List()
 	if err != nil {
-		fmt.Println(err)
-		serveError(w, err)
+		k.serveError(w, err)
+		return
+	}
+	if err := viewTemplate.Execute(w, struct{ Hooks []*Webhook }{Hooks: hooks}); err != nil {
+		k.serveError(w, err)
 	}
 }
 
-func parseWebhook(r io.Reader) (v interface{}, kind string, err error) {
-	b, err := ioutil.ReadAll(r)
+func (k *Krud) push(w http.ResponseWriter, r *http.Request) {
+	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		return nil, "", err
+		k.serveError(w, err)
+		return
 	}
-	{
-		var d QuayWebhook
-		if err := json.Unmarshal(b, &d); err == nil {
-			return d, "quay.io", nil
-		}
+	provider, d, kind, err := parseWebhook(r.Header, b)
+	if err != nil {
+		k.serveError(w, err)
+		return
 	}
-	{
-		var d DockerWebhook
-		if err := json.Unmarshal(b, &d); err == nil {
-			return d, "docker hub", nil
+	if !k.verifyWebhook(r, kind, b) {
+		webhooksReceivedTotal.WithLabelValues(kind, "false").Inc()
+		http.Error(w, "webhook failed verification", http.StatusUnauthorized)
+		return
+	}
+	webhooksReceivedTotal.WithLabelValues(kind, "true").Inc()
+	if dh, ok := d.(DockerWebhook); ok && dh.CallbackURL != "" {
+		if err := ackDockerHubCallback(dh.CallbackURL); err != nil {
+			k.Log.Errorw("docker hub callback ack failed", "error", err)
 		}
 	}
-	return nil, "", fmt.Errorf("unrecognized webhook")
-}
-
-func (k *Krud) push(w http.ResponseWriter, r *http.Request) {
-	d, kind, err := parseWebhook(r.Body)
-	if err != nil {
-		serveError(w, err)
-		return
+	var repo, tag string
+	if repo, tag, err = provider.Image(d); err == nil {
+		if !k.imageMatches(repo, tag) {
+			k.Log.Infow("ignoring webhook: does not match current image", "source", kind, "repo", repo, "tag", tag)
+			return
+		}
 	}
-	k.Lock()
-	defer k.Unlock()
+	now := time.Now()
 	wh := &Webhook{
-		Data:     &d,
-		Kind:     kind,
-		Source:   r.RemoteAddr,
-		Received: time.Now(),
+		ID:        fmt.Sprintf("%019d", now.UnixNano()),
+		Data:      &d,
+		Kind:      kind,
+		Source:    r.RemoteAddr,
+		Received:  now,
+		Verified:  true,
+		ImageRepo: repo,
+		ImageTag:  tag,
 	}
-	k.Hooks = append(k.Hooks, wh)
+	if err := k.Store.Add(wh); err != nil {
+		k.serveError(w, err)
+		return
+	}
+	queueDepth.Inc()
 	go func() {
 		k.Next <- wh
 	}()
 }
 
-func (k *Krud) update(h *Webhook) error {
-	h.UpdateAttempt = true
-	h.UpdateStart = time.Now()
-	defer func() {
-		h.UpdateEnd = time.Now()
-	}()
-	conf := &client.Config{
-		Host: k.Endpoint,
-	}
-	client, err := client.New(conf)
+// imageMatches reports whether repo/tag (as extracted from a webhook) refer
+// to the image the managed controller is currently running. A lookup failure
+// fails open, since refusing to ever roll is worse than the rare spurious
+// update.
+func (k *Krud) imageMatches(repo, tag string) bool {
+	curRepo, curTag, err := k.currentImage()
 	if err != nil {
-		return err
+		k.Log.Warnw("unable to determine current image, accepting webhook", "error", err)
+		return true
 	}
-	if k.Namespace == "" {
-		k.Namespace = api.NamespaceDefault
+	if repo != "" && curRepo != "" && !strings.HasSuffix(curRepo, repo) && !strings.HasSuffix(repo, curRepo) {
+		return false
 	}
-	rcs := client.ReplicationControllers(k.Namespace)
-	oldRc, err := rcs.Get(k.ControllerName)
-	if err != nil {
-		return err
-	}
-	newRc, err := rcs.Get(k.ControllerName)
-	if err != nil {
-		return err
-	}
-	hash, err := api.HashObject(oldRc, client.Codec)
-	if err != nil {
-		return err
+	if tag != "" && curTag != "" && tag != curTag {
+		return false
 	}
-	h.UpdateID = hash
-	newRc.Name = fmt.Sprintf("%s-%s", k.ControllerName, hash)
-	newRc.ResourceVersion = ""
-	apply := func(key, value string, ms ...map[string]string) {
-		for _, m := range ms {
-			m[key] = value
+	return true
+}
+
+// currentImage returns the repo and tag of the managed controller's current
+// container image, read from the informer cache rather than the API server.
+func (k *Krud) currentImage() (repo, tag string, err error) {
+	ns := k.namespaceOrDefault()
+	var containers []v1.Container
+	switch k.ResourceKind {
+	case "deployment":
+		d, err := k.deploymentLister.Deployments(ns).Get(k.ControllerName)
+		if err != nil {
+			return "", "", err
+		}
+		containers = d.Spec.Template.Spec.Containers
+	case "statefulset":
+		s, err := k.statefulSetLister.StatefulSets(ns).Get(k.ControllerName)
+		if err != nil {
+			return "", "", err
 		}
+		containers = s.Spec.Template.Spec.Containers
+	default:
+		rc, err := k.rcLister.ReplicationControllers(ns).Get(k.ControllerName)
+		if err != nil {
+			return "", "", err
+		}
+		containers = rc.Spec.Template.Spec.Containers
 	}
-	apply(k.DeploymentKey, hash, newRc.Spec.Selector, newRc.Spec.Template.Labels)
-	apply("run", k.ControllerName, newRc.Spec.Selector, newRc.Spec.Template.Labels)
-	ruconf := kubectl.RollingUpdaterConfig{
-		Out: &lockBuffer{
-			k: k,
-			h: h,
-		},
-		OldRc:          oldRc,
-		NewRc:          newRc,
-		UpdatePeriod:   time.Second * 3, // todo: change to time.Minute
-		Timeout:        time.Minute * 5,
-		Interval:       time.Second * 3,
-		UpdateAcceptor: kubectl.DefaultUpdateAcceptor,
-		CleanupPolicy:  kubectl.RenameRollingUpdateCleanupPolicy,
+	if len(containers) == 0 {
+		return "", "", fmt.Errorf("%s %s has no containers", k.ResourceKind, k.ControllerName)
 	}
-	ruc := kubectl.NewRollingUpdaterClient(client)
-	println("doing rolling update")
-	err = kubectl.NewRollingUpdater(k.Namespace, ruc).Update(&ruconf)
-	println("done")
-	k.Lock()
-	h.UpdateSuccess = err == nil
-	k.Unlock()
-	return err
-}
-
-type lockBuffer struct {
-	k *Krud
-	h *Webhook
+	return splitImage(containers[0].Image)
 }
 
-func (l *lockBuffer) Write(p []byte) (n int, err error) {
-	l.k.Lock()
-	defer l.k.Unlock()
-	l.h.UpdateStatus += string(p)
-	fmt.Println("WRITE", string(p))
-	return len(p), nil
+// splitImage splits a container image reference into its repository and tag,
+// taking care not to mistake a registry port for a tag separator.
+func splitImage(image string) (repo, tag string) {
+	i := strings.LastIndex(image, ":")
+	if i < 0 || strings.Contains(image[i+1:], "/") {
+		return image, ""
+	}
+	return image[:i], image[i+1:]
 }
 
 const indexHTML = `<!DOCTYPE html>
@@ -304,12 +427,32 @@ const indexHTML = `<!DOCTYPE html>
 	<body>
 		{{range .Hooks}}
 			<div>
-				Err: {{.UpdateError}}
-				<br>Status: <pre>{{.UpdateStatus}}</pre>
+				Verified: {{.Verified}}
+				<br>RolledBack: {{.RolledBack}}
+				<br>Err: {{.UpdateError}}
+				<br>Status: <pre id="status-{{.ID}}">{{.UpdateStatus}}</pre>
 				<br>Value: <pre>{{. | json}}</pre>
 			</div>
 			<hr>
 		{{end}}
+		<script>
+			var events = new EventSource("/events");
+			function onRolloutEvent(msg) {
+				var e = JSON.parse(msg.data);
+				var pre = document.getElementById("status-" + e.hook_id);
+				if (!pre) {
+					return;
+				}
+				if (e.type === "update.progress") {
+					pre.textContent += e.data;
+				} else {
+					pre.textContent += "\n[" + e.type + "] " + e.data + "\n";
+				}
+			}
+			["update.start", "update.progress", "update.success", "update.error"].forEach(function(type) {
+				events.addEventListener(type, onRolloutEvent);
+			});
+		</script>
 	</body>
 </html>
 `
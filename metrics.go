@@ -0,0 +1,41 @@
+package main
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	webhooksReceivedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "krud_webhooks_received_total",
+		Help: "Webhooks received, by source and whether they passed verification.",
+	}, []string{"source", "verified"})
+
+	updatesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "krud_updates_total",
+		Help: "Rollouts attempted, by result.",
+	}, []string{"result"})
+
+	updateDurationSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "krud_update_duration_seconds",
+		Help:    "Time taken by a rollout attempt, success or failure.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	queueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "krud_queue_depth",
+		Help: "Webhooks received but not yet applied.",
+	})
+
+	currentDeploymentID = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "krud_current_deployment_id",
+		Help: "Numeric form of the hash tagging the currently applied rollout, by controller.",
+	}, []string{"controller"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		webhooksReceivedTotal,
+		updatesTotal,
+		updateDurationSeconds,
+		queueDepth,
+		currentDeploymentID,
+	)
+}
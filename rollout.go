@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/watch"
+
+	legacyapi "k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/kubectl"
+)
+
+// update rolls out h against k.ControllerName, dispatching on k.ResourceKind.
+func (k *Krud) update(h *Webhook) error {
+	k.Lock()
+	h.RolledBack = false
+	h.UpdateError = ""
+	k.Unlock()
+	h.UpdateAttempt = true
+	h.UpdateStart = time.Now()
+	k.publish(h, "update.start", k.ResourceKind)
+	defer func() {
+		h.UpdateEnd = time.Now()
+		updateDurationSeconds.Observe(h.UpdateEnd.Sub(h.UpdateStart).Seconds())
+	}()
+
+	var err error
+	switch k.ResourceKind {
+	case "deployment":
+		err = k.updateDeployment(h)
+	case "statefulset":
+		err = k.updateStatefulSet(h)
+	default:
+		err = k.updateReplicationController(h)
+	}
+
+	result := "success"
+	switch {
+	case h.RolledBack:
+		result = "rollback"
+		k.publish(h, "update.error", err.Error())
+	case err != nil:
+		result = "error"
+		k.publish(h, "update.error", err.Error())
+	default:
+		k.publish(h, "update.success", "")
+	}
+	updatesTotal.WithLabelValues(result).Inc()
+	if err == nil {
+		if n, perr := strconv.ParseUint(h.UpdateID, 16, 64); perr == nil {
+			currentDeploymentID.WithLabelValues(k.ControllerName).Set(float64(n))
+		}
+	}
+	return err
+}
+
+// updateReplicationController performs the original rolling-update behavior:
+// create a new RC alongside the old one and let kubectl's RollingUpdater
+// scale one up and the other down. This still goes through the pre-client-go
+// client, which is what kubectl.RollingUpdater is built against.
+func (k *Krud) updateReplicationController(h *Webhook) error {
+	c := k.LegacyClient
+	ns := k.namespaceOrDefault()
+	rcs := c.ReplicationControllers(ns)
+	oldRc, err := rcs.Get(k.ControllerName)
+	if err != nil {
+		return err
+	}
+	newRc, err := rcs.Get(k.ControllerName)
+	if err != nil {
+		return err
+	}
+	hash, err := legacyapi.HashObject(oldRc, c.Codec)
+	if err != nil {
+		return err
+	}
+	h.UpdateID = hash
+	newRc.Name = fmt.Sprintf("%s-%s", k.ControllerName, hash)
+	newRc.ResourceVersion = ""
+	apply := func(key, value string, ms ...map[string]string) {
+		for _, m := range ms {
+			m[key] = value
+		}
+	}
+	apply(k.DeploymentKey, hash, newRc.Spec.Selector, newRc.Spec.Template.Labels)
+	apply("run", k.ControllerName, newRc.Spec.Selector, newRc.Spec.Template.Labels)
+	ruconf := kubectl.RollingUpdaterConfig{
+		Out: &lockBuffer{
+			k: k,
+			h: h,
+		},
+		OldRc:          oldRc,
+		NewRc:          newRc,
+		UpdatePeriod:   k.UpdatePeriod,
+		Timeout:        k.Timeout,
+		Interval:       k.UpdatePeriod,
+		UpdateAcceptor: kubectl.DefaultUpdateAcceptor,
+		CleanupPolicy:  kubectl.RenameRollingUpdateCleanupPolicy,
+	}
+	ruc := kubectl.NewRollingUpdaterClient(c)
+	k.Log.Infow("starting rolling update", "webhook_id", h.ID, "update_id", hash)
+	err = kubectl.NewRollingUpdater(ns, ruc).Update(&ruconf)
+	k.Log.Infow("rolling update finished", "webhook_id", h.ID, "update_id", hash, "error", err)
+	k.Lock()
+	h.UpdateSuccess = err == nil
+	k.Unlock()
+	k.saveHook(h)
+	return err
+}
+
+// patchedContainerImages rewrites the image of any container whose current
+// repository matches h's, falling back to the first container when none do,
+// and returns the images that were in place beforehand so they can be
+// restored on rollback.
+func patchedContainerImages(containers []v1.Container, h *Webhook) []string {
+	prev := make([]string, len(containers))
+	patched := false
+	for i := range containers {
+		prev[i] = containers[i].Image
+		repo, _ := splitImage(containers[i].Image)
+		if h.ImageRepo != "" && (strings.HasSuffix(repo, h.ImageRepo) || strings.HasSuffix(h.ImageRepo, repo)) {
+			containers[i].Image = fmt.Sprintf("%s:%s", repo, h.ImageTag)
+			patched = true
+		}
+	}
+	if !patched && len(containers) > 0 {
+		repo, _ := splitImage(containers[0].Image)
+		containers[0].Image = fmt.Sprintf("%s:%s", repo, h.ImageTag)
+	}
+	return prev
+}
+
+// hashObject returns a short, stable hash of v, used to tag a rollout the
+// same way the old api.HashObject did for replication controllers.
+func hashObject(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	h := fnv.New32a()
+	h.Write(b)
+	return fmt.Sprintf("%08x", h.Sum32()), nil
+}
+
+// updateDeployment patches the Deployment's container image(s) in place and
+// watches .status until the rollout is fully rolled out, rolling back to the
+// prior images on timeout or failed readiness.
+func (k *Krud) updateDeployment(h *Webhook) error {
+	ns := k.namespaceOrDefault()
+	deployments := k.Client.AppsV1().Deployments(ns)
+	d, err := deployments.Get(context.Background(), k.ControllerName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	hash, err := hashObject(d.Spec)
+	if err != nil {
+		return err
+	}
+	h.UpdateID = hash
+
+	prevImages := patchedContainerImages(d.Spec.Template.Spec.Containers, h)
+	d.Spec.Strategy = appsv1.DeploymentStrategy{
+		Type: appsv1.RollingUpdateDeploymentStrategyType,
+		RollingUpdate: &appsv1.RollingUpdateDeployment{
+			MaxSurge:       intOrString(k.MaxSurge),
+			MaxUnavailable: intOrString(k.MaxUnavailable),
+		},
+	}
+	updated, err := deployments.Update(context.Background(), d, metav1.UpdateOptions{})
+	if err != nil {
+		return err
+	}
+
+	watcher, err := deployments.Watch(context.Background(), k.watchOptions())
+	if err != nil {
+		return err
+	}
+	ready, err := k.waitForRollout(h, updated.Generation, watcher, func(obj runtime.Object) (generation, updatedReplicas, replicas int64, ok bool) {
+		cur, ok := obj.(*appsv1.Deployment)
+		if !ok || cur.Spec.Replicas == nil {
+			return 0, 0, 0, false
+		}
+		return cur.Status.ObservedGeneration, int64(cur.Status.UpdatedReplicas), int64(*cur.Spec.Replicas), true
+	})
+	if err != nil {
+		return err
+	}
+	if ready {
+		k.Lock()
+		h.UpdateSuccess = true
+		k.Unlock()
+		k.saveHook(h)
+		return nil
+	}
+
+	cur, err := deployments.Get(context.Background(), k.ControllerName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("rollout timed out after %s, rollback failed: %v", k.Timeout, err)
+	}
+	for i, image := range prevImages {
+		if i < len(cur.Spec.Template.Spec.Containers) {
+			cur.Spec.Template.Spec.Containers[i].Image = image
+		}
+	}
+	if _, err := deployments.Update(context.Background(), cur, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("rollout timed out after %s, rollback failed: %v", k.Timeout, err)
+	}
+	k.Lock()
+	h.RolledBack = true
+	k.Unlock()
+	k.saveHook(h)
+	return fmt.Errorf("rollout timed out after %s, rolled back to prior image(s)", k.Timeout)
+}
+
+// updateStatefulSet mirrors updateDeployment for StatefulSets.
+func (k *Krud) updateStatefulSet(h *Webhook) error {
+	ns := k.namespaceOrDefault()
+	sets := k.Client.AppsV1().StatefulSets(ns)
+	s, err := sets.Get(context.Background(), k.ControllerName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	hash, err := hashObject(s.Spec)
+	if err != nil {
+		return err
+	}
+	h.UpdateID = hash
+
+	prevImages := patchedContainerImages(s.Spec.Template.Spec.Containers, h)
+	s.Spec.UpdateStrategy = appsv1.StatefulSetUpdateStrategy{
+		Type: appsv1.RollingUpdateStatefulSetStrategyType,
+		RollingUpdate: &appsv1.RollingUpdateStatefulSetStrategy{
+			MaxUnavailable: intOrString(k.MaxUnavailable),
+		},
+	}
+	updated, err := sets.Update(context.Background(), s, metav1.UpdateOptions{})
+	if err != nil {
+		return err
+	}
+
+	watcher, err := sets.Watch(context.Background(), k.watchOptions())
+	if err != nil {
+		return err
+	}
+	ready, err := k.waitForRollout(h, updated.Generation, watcher, func(obj runtime.Object) (generation, updatedReplicas, replicas int64, ok bool) {
+		cur, ok := obj.(*appsv1.StatefulSet)
+		if !ok || cur.Spec.Replicas == nil {
+			return 0, 0, 0, false
+		}
+		return cur.Status.ObservedGeneration, int64(cur.Status.UpdatedReplicas), int64(*cur.Spec.Replicas), true
+	})
+	if err != nil {
+		return err
+	}
+	if ready {
+		k.Lock()
+		h.UpdateSuccess = true
+		k.Unlock()
+		k.saveHook(h)
+		return nil
+	}
+
+	cur, err := sets.Get(context.Background(), k.ControllerName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("rollout timed out after %s, rollback failed: %v", k.Timeout, err)
+	}
+	for i, image := range prevImages {
+		if i < len(cur.Spec.Template.Spec.Containers) {
+			cur.Spec.Template.Spec.Containers[i].Image = image
+		}
+	}
+	if _, err := sets.Update(context.Background(), cur, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("rollout timed out after %s, rollback failed: %v", k.Timeout, err)
+	}
+	k.Lock()
+	h.RolledBack = true
+	k.Unlock()
+	k.saveHook(h)
+	return fmt.Errorf("rollout timed out after %s, rolled back to prior image(s)", k.Timeout)
+}
+
+// intOrString parses a flag value ("3" or "25%") the same way kubectl does
+// for --max-surge/--max-unavailable.
+func intOrString(s string) *intstr.IntOrString {
+	v := intstr.Parse(s)
+	return &v
+}
+
+// watchOptions scopes a Watch call to just k.ControllerName, so waitForRollout
+// only ever sees events for the resource it's rolling out.
+func (k *Krud) watchOptions() metav1.ListOptions {
+	return metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("metadata.name", k.ControllerName).String(),
+	}
+}
+
+// waitForRollout consumes watcher until it reports the rollout complete
+// (observed generation caught up and every replica updated) or k.Timeout
+// elapses, rather than polling status on an interval.
+func (k *Krud) waitForRollout(h *Webhook, generation int64, watcher watch.Interface, extract func(obj runtime.Object) (observedGeneration, updatedReplicas, replicas int64, ok bool)) (bool, error) {
+	defer watcher.Stop()
+	out := &lockBuffer{k: k, h: h}
+	timeout := time.NewTimer(k.Timeout)
+	defer timeout.Stop()
+
+	for {
+		select {
+		case event, ok := <-watcher.ResultChan():
+			if !ok {
+				return false, fmt.Errorf("watch closed before the rollout completed")
+			}
+			if event.Type == watch.Error {
+				continue
+			}
+			observedGeneration, updatedReplicas, replicas, ok := extract(event.Object)
+			if !ok {
+				continue
+			}
+			fmt.Fprintf(out, "observedGeneration=%d/%d updatedReplicas=%d/%d\n", observedGeneration, generation, updatedReplicas, replicas)
+			if observedGeneration >= generation && updatedReplicas == replicas {
+				return true, nil
+			}
+		case <-timeout.C:
+			return false, nil
+		}
+	}
+}
+
+type lockBuffer struct {
+	k *Krud
+	h *Webhook
+}
+
+func (l *lockBuffer) Write(p []byte) (n int, err error) {
+	l.k.Lock()
+	defer l.k.Unlock()
+	l.h.UpdateStatus += string(p)
+	l.k.Log.Debugw("rollout status", "webhook_id", l.h.ID, "controller", l.k.ControllerName, "chunk", string(p))
+	l.k.publish(l.h, "update.progress", string(p))
+	return len(p), nil
+}
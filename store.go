@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/boltdb/bolt"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// HookStore persists the history of received webhooks. Add records a newly
+// received webhook; Save persists updates made to one already added (e.g.
+// once its update attempt completes); List and Get read it back, most
+// recently received first.
+type HookStore interface {
+	Add(h *Webhook) error
+	Save(h *Webhook) error
+	List() ([]*Webhook, error)
+	Get(id string) (*Webhook, error)
+}
+
+// newHookStore builds the HookStore selected by --store.
+func newHookStore(kind string, max int, historyPath, configMapName string, k *Krud) (HookStore, error) {
+	switch kind {
+	case "memory":
+		return newMemoryStore(max), nil
+	case "bolt":
+		return newBoltStore(historyPath, max)
+	case "configmap":
+		return newConfigMapStore(configMapName, max, k), nil
+	default:
+		return nil, fmt.Errorf("--store must be one of memory, bolt, configmap")
+	}
+}
+
+// memoryStore keeps the most recent webhooks in a ring buffer in memory; it
+// is lost on restart.
+type memoryStore struct {
+	max int
+
+	mu    sync.Mutex
+	hooks []*Webhook
+}
+
+func newMemoryStore(max int) *memoryStore {
+	return &memoryStore{max: max}
+}
+
+func (s *memoryStore) Add(h *Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hooks = append(s.hooks, h)
+	if s.max > 0 && len(s.hooks) > s.max {
+		s.hooks = s.hooks[len(s.hooks)-s.max:]
+	}
+	return nil
+}
+
+func (s *memoryStore) Save(h *Webhook) error {
+	// h is a pointer shared with whatever Add appended, so there is nothing
+	// further to persist.
+	return nil
+}
+
+func (s *memoryStore) List() ([]*Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]*Webhook, len(s.hooks))
+	for i, h := range s.hooks {
+		out[len(s.hooks)-1-i] = h
+	}
+	return out, nil
+}
+
+func (s *memoryStore) Get(id string) (*Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, h := range s.hooks {
+		if h.ID == id {
+			return h, nil
+		}
+	}
+	return nil, fmt.Errorf("no webhook with id %q", id)
+}
+
+var hooksBucket = []byte("hooks")
+
+// boltStore persists webhooks to a BoltDB file on disk, keyed by h.ID so the
+// bucket's natural (byte-ordered) cursor order is also chronological order.
+type boltStore struct {
+	db  *bolt.DB
+	max int
+}
+
+func newBoltStore(path string, max int) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(hooksBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db, max: max}, nil
+}
+
+func (s *boltStore) Add(h *Webhook) error {
+	if err := s.put(h); err != nil {
+		return err
+	}
+	return s.trim()
+}
+
+func (s *boltStore) Save(h *Webhook) error {
+	return s.put(h)
+}
+
+func (s *boltStore) put(h *Webhook) error {
+	b, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(hooksBucket).Put([]byte(h.ID), b)
+	})
+}
+
+// trim drops the oldest entries once the bucket exceeds s.max, relying on
+// the fixed-width ID's byte order matching chronological order.
+func (s *boltStore) trim() error {
+	if s.max <= 0 {
+		return nil
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(hooksBucket)
+		n := bucket.Stats().KeyN
+		if n <= s.max {
+			return nil
+		}
+		c := bucket.Cursor()
+		for k, _ := c.First(); k != nil && n > s.max; k, _ = c.Next() {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+			n--
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) List() ([]*Webhook, error) {
+	var out []*Webhook
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(hooksBucket).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var h Webhook
+			if err := json.Unmarshal(v, &h); err != nil {
+				return err
+			}
+			out = append(out, &h)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (s *boltStore) Get(id string) (*Webhook, error) {
+	var h *Webhook
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(hooksBucket).Get([]byte(id))
+		if v == nil {
+			return fmt.Errorf("no webhook with id %q", id)
+		}
+		h = &Webhook{}
+		return json.Unmarshal(v, h)
+	}); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// configMapStore persists the whole history as one JSON blob in a single
+// ConfigMap key, so multiple krud replicas sharing a namespace see the same
+// history. Writes are last-writer-wins: there is no merge across concurrent
+// updates, which is acceptable for the "which hooks fired" history this
+// backs, but would not be for anything requiring a real log.
+type configMapStore struct {
+	name string
+	max  int
+	k    *Krud
+
+	mu sync.Mutex
+}
+
+const configMapDataKey = "hooks.json"
+
+func newConfigMapStore(name string, max int, k *Krud) *configMapStore {
+	return &configMapStore{name: name, max: max, k: k}
+}
+
+func (s *configMapStore) Add(h *Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hooks, err := s.load()
+	if err != nil {
+		return err
+	}
+	hooks = append(hooks, h)
+	if s.max > 0 && len(hooks) > s.max {
+		hooks = hooks[len(hooks)-s.max:]
+	}
+	return s.store(hooks)
+}
+
+func (s *configMapStore) Save(h *Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hooks, err := s.load()
+	if err != nil {
+		return err
+	}
+	for i, existing := range hooks {
+		if existing.ID == h.ID {
+			hooks[i] = h
+			return s.store(hooks)
+		}
+	}
+	return s.store(append(hooks, h))
+}
+
+func (s *configMapStore) List() ([]*Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hooks, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].ID > hooks[j].ID })
+	return hooks, nil
+}
+
+func (s *configMapStore) Get(id string) (*Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hooks, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range hooks {
+		if h.ID == id {
+			return h, nil
+		}
+	}
+	return nil, fmt.Errorf("no webhook with id %q", id)
+}
+
+func (s *configMapStore) load() ([]*Webhook, error) {
+	cms := s.k.Client.CoreV1().ConfigMaps(s.k.namespaceOrDefault())
+	cm, err := cms.Get(context.Background(), s.name, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	data := cm.Data[configMapDataKey]
+	if data == "" {
+		return nil, nil
+	}
+	var hooks []*Webhook
+	if err := json.Unmarshal([]byte(data), &hooks); err != nil {
+		return nil, err
+	}
+	return hooks, nil
+}
+
+func (s *configMapStore) store(hooks []*Webhook) error {
+	b, err := json.Marshal(hooks)
+	if err != nil {
+		return err
+	}
+	cms := s.k.Client.CoreV1().ConfigMaps(s.k.namespaceOrDefault())
+	ctx := context.Background()
+	cm, err := cms.Get(ctx, s.name, metav1.GetOptions{})
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+		_, err := cms.Create(ctx, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: s.name},
+			Data:       map[string]string{configMapDataKey: string(b)},
+		}, metav1.CreateOptions{})
+		return err
+	}
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[configMapDataKey] = string(b)
+	_, err = cms.Update(ctx, cm, metav1.UpdateOptions{})
+	return err
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestMemoryStoreTrimsToMax(t *testing.T) {
+	s := newMemoryStore(2)
+	for _, id := range []string{"1", "2", "3"} {
+		if err := s.Add(&Webhook{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hooks, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hooks) != 2 {
+		t.Fatalf("got %d hooks, want 2", len(hooks))
+	}
+	// List returns most recently received first.
+	if hooks[0].ID != "3" || hooks[1].ID != "2" {
+		t.Fatalf("got ids %q, %q, want 3, 2", hooks[0].ID, hooks[1].ID)
+	}
+	if _, err := s.Get("1"); err == nil {
+		t.Fatal("expected the trimmed hook 1 to be gone")
+	}
+}
+
+func TestMemoryStoreUnboundedWhenMaxIsZero(t *testing.T) {
+	s := newMemoryStore(0)
+	for i := 0; i < 10; i++ {
+		if err := s.Add(&Webhook{ID: string(rune('a' + i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hooks, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hooks) != 10 {
+		t.Fatalf("got %d hooks, want 10", len(hooks))
+	}
+}
+
+func TestBoltStoreTrimsToMax(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hooks.db")
+	s, err := newBoltStore(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.db.Close()
+
+	for _, id := range []string{"1", "2", "3"} {
+		if err := s.Add(&Webhook{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hooks, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hooks) != 2 {
+		t.Fatalf("got %d hooks, want 2", len(hooks))
+	}
+	if hooks[0].ID != "3" || hooks[1].ID != "2" {
+		t.Fatalf("got ids %q, %q, want 3, 2", hooks[0].ID, hooks[1].ID)
+	}
+	if _, err := s.Get("1"); err == nil {
+		t.Fatal("expected the trimmed hook 1 to be gone")
+	}
+}
+
+func TestBoltStoreRoundTripsUpdateError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hooks.db")
+	s, err := newBoltStore(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.db.Close()
+
+	h := &Webhook{ID: "1", UpdateError: "image pull failed"}
+	if err := s.Add(h); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Get("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.UpdateError != "image pull failed" {
+		t.Errorf("UpdateError = %q, want %q", got.UpdateError, "image pull failed")
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// WebhookProvider recognizes and decodes webhooks from a single registry or
+// CI source. Providers are tried in the order they're registered in
+// webhookProviders; the first one whose Match returns true handles the
+// request.
+type WebhookProvider interface {
+	// Match reports whether body (together with the request's headers) is a
+	// webhook this provider understands.
+	Match(headers http.Header, body []byte) bool
+	// Parse decodes body into the provider's own payload type, along with a
+	// human-readable kind to record on the Webhook.
+	Parse(body []byte) (v interface{}, kind string, err error)
+	// Image extracts the repository and tag a parsed payload refers to, so
+	// callers can tell whether it matches a deployment's current image.
+	Image(v interface{}) (repo, tag string, err error)
+}
+
+// webhookProviders lists the built-in providers, most distinctive first so a
+// generic JSON body doesn't shadow a better match.
+var webhookProviders = []WebhookProvider{
+	githubProvider{},
+	gitlabProvider{},
+	harborProvider{},
+	quayProvider{},
+	dockerHubProvider{},
+	genericProvider{},
+}
+
+// parseWebhook runs the provider registry against body, returning the
+// matching provider alongside its parsed result.
+func parseWebhook(headers http.Header, body []byte) (provider WebhookProvider, v interface{}, kind string, err error) {
+	for _, p := range webhookProviders {
+		if p.Match(headers, body) {
+			v, kind, err = p.Parse(body)
+			return p, v, kind, err
+		}
+	}
+	return nil, nil, "", fmt.Errorf("unrecognized webhook")
+}
+
+// hasKeys reports whether body is a JSON object containing all of keys.
+func hasKeys(body []byte, keys ...string) bool {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(body, &m); err != nil {
+		return false
+	}
+	for _, k := range keys {
+		if _, ok := m[k]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// verifyWebhook checks the incoming request against the secret configured
+// for its source, rejecting anything that doesn't carry proof of origin.
+// body is the raw, unparsed request body, since GitHub's signature covers
+// the exact bytes sent and is invalidated by re-marshaling.
+func (k *Krud) verifyWebhook(r *http.Request, kind string, body []byte) bool {
+	switch kind {
+	case "quay.io":
+		secret := k.QuaySecret
+		if secret == "" {
+			secret = k.WebhookSecret
+		}
+		return secret != "" && secureCompare(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), secret)
+	case "docker hub":
+		secret := k.DockerHubToken
+		if secret == "" {
+			secret = k.WebhookSecret
+		}
+		return secret != "" && secureCompare(r.URL.Query().Get("token"), secret)
+	case "github container registry":
+		secret := k.GithubSecret
+		if secret == "" {
+			secret = k.WebhookSecret
+		}
+		return secret != "" && verifyGithubSignature(body, secret, r.Header.Get("X-Hub-Signature-256"))
+	case "gitlab":
+		secret := k.GitLabToken
+		if secret == "" {
+			secret = k.WebhookSecret
+		}
+		return secret != "" && secureCompare(r.Header.Get("X-Gitlab-Token"), secret)
+	default:
+		// Harbor and sources without a dedicated secret flag fall back to a
+		// single shared token, since otherwise adding a provider here would
+		// silently open up an unauthenticated update path. Harbor does support
+		// its own "Auth Header" mechanism (an arbitrary Authorization value
+		// the operator configures), but this fallback doesn't implement it;
+		// an operator relying on Harbor must append ?token=... to the
+		// configured webhook URL like any other generic source.
+		if k.WebhookSecret == "" {
+			return false
+		}
+		token := r.Header.Get("X-Webhook-Token")
+		if token == "" {
+			token = r.URL.Query().Get("token")
+		}
+		return secureCompare(token, k.WebhookSecret)
+	}
+}
+
+// verifyGithubSignature reports whether header is a valid
+// "sha256=<hex hmac>" X-Hub-Signature-256 value for body under secret, the
+// mechanism GitHub uses to prove a webhook delivery is genuine.
+func verifyGithubSignature(body []byte, secret, header string) bool {
+	const prefix = "sha256="
+	if !strings.HasPrefix(header, prefix) {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	want := hex.EncodeToString(mac.Sum(nil))
+	return secureCompare(strings.TrimPrefix(header, prefix), want)
+}
+
+func secureCompare(got, want string) bool {
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// ackDockerHubCallback posts the JSON acknowledgement Docker Hub expects back
+// to callbackURL, which is how Docker Hub confirms the hook was received.
+func ackDockerHubCallback(callbackURL string) error {
+	body, err := json.Marshal(struct {
+		State       string `json:"state"`
+		Description string `json:"description"`
+		Context     string `json:"context"`
+	}{
+		State:       "success",
+		Description: "received by krud",
+		Context:     "krud",
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(callbackURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("docker hub callback returned %s", resp.Status)
+	}
+	return nil
+}
+
+// QuayWebhook is the payload Quay.io's "Repository Push" notification sends.
+type QuayWebhook struct {
+	DockerURL        string `json:"docker_url"`
+	Homepage         string
+	Name             string
+	Namespace        string
+	PrunedImageCount int `json:"pruned_image_count"`
+	PushedImageCount int `json:"pushed_image_count"`
+	Repository       string
+	UpdatedTags      struct {
+		Latest string
+	} `json:"updated_tags"`
+	Visibility string
+}
+
+type quayProvider struct{}
+
+func (quayProvider) Match(headers http.Header, body []byte) bool {
+	return hasKeys(body, "docker_url", "repository", "updated_tags")
+}
+
+func (quayProvider) Parse(body []byte) (interface{}, string, error) {
+	var d QuayWebhook
+	if err := json.Unmarshal(body, &d); err != nil {
+		return nil, "", err
+	}
+	return d, "quay.io", nil
+}
+
+func (quayProvider) Image(v interface{}) (repo, tag string, err error) {
+	d, ok := v.(QuayWebhook)
+	if !ok {
+		return "", "", fmt.Errorf("not a quay.io webhook")
+	}
+	return d.Repository, d.UpdatedTags.Latest, nil
+}
+
+// DockerWebhook is the payload Docker Hub's "Webhooks" feature sends.
+type DockerWebhook struct {
+	CallbackURL string `json:"callback_url"`
+	PushData    struct {
+		Images   interface{} `json:"images"`
+		PushedAt int         `json:"pushed_at"`
+		Pusher   string      `json:"pusher"`
+		Tag      string      `json:"tag"`
+	} `json:"push_data"`
+	Repository struct {
+		CommentCount    int    `json:"comment_count"`
+		DateCreated     int    `json:"date_created"`
+		Description     string `json:"description"`
+		FullDescription string `json:"full_description"`
+		IsOfficial      bool   `json:"is_official"`
+		IsPrivate       bool   `json:"is_private"`
+		IsTrusted       bool   `json:"is_trusted"`
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		Owner           string `json:"owner"`
+		RepoName        string `json:"repo_name"`
+		RepoURL         string `json:"repo_url"`
+		StarCount       int    `json:"star_count"`
+		Status          string `json:"status"`
+	} `json:"repository"`
+}
+
+type dockerHubProvider struct{}
+
+func (dockerHubProvider) Match(headers http.Header, body []byte) bool {
+	return hasKeys(body, "push_data", "repository", "callback_url")
+}
+
+func (dockerHubProvider) Parse(body []byte) (interface{}, string, error) {
+	var d DockerWebhook
+	if err := json.Unmarshal(body, &d); err != nil {
+		return nil, "", err
+	}
+	return d, "docker hub", nil
+}
+
+func (dockerHubProvider) Image(v interface{}) (repo, tag string, err error) {
+	d, ok := v.(DockerWebhook)
+	if !ok {
+		return "", "", fmt.Errorf("not a docker hub webhook")
+	}
+	return d.Repository.RepoName, d.PushData.Tag, nil
+}
+
+// GithubPackageWebhook is the payload GitHub Container Registry sends for a
+// "package" event.
+type GithubPackageWebhook struct {
+	Action  string `json:"action"`
+	Package struct {
+		Name           string `json:"name"`
+		PackageType    string `json:"package_type"`
+		PackageVersion struct {
+			Version           string `json:"version"`
+			ContainerMetadata struct {
+				Tag struct {
+					Name   string `json:"name"`
+					Digest string `json:"digest"`
+				} `json:"tag"`
+			} `json:"container_metadata"`
+		} `json:"package_version"`
+	} `json:"package"`
+	Repository struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+}
+
+type githubProvider struct{}
+
+func (githubProvider) Match(headers http.Header, body []byte) bool {
+	return headers.Get("X-GitHub-Event") == "package" && hasKeys(body, "action", "package")
+}
+
+func (githubProvider) Parse(body []byte) (interface{}, string, error) {
+	var d GithubPackageWebhook
+	if err := json.Unmarshal(body, &d); err != nil {
+		return nil, "", err
+	}
+	return d, "github container registry", nil
+}
+
+func (githubProvider) Image(v interface{}) (repo, tag string, err error) {
+	d, ok := v.(GithubPackageWebhook)
+	if !ok {
+		return "", "", fmt.Errorf("not a github package webhook")
+	}
+	return d.Repository.FullName, d.Package.PackageVersion.ContainerMetadata.Tag.Name, nil
+}
+
+// GitLabContainerRegistryWebhook is the payload GitLab's container registry
+// integration sends when an image is pushed.
+type GitLabContainerRegistryWebhook struct {
+	ObjectKind string `json:"object_kind"`
+	Registry   struct {
+		Path string `json:"path"`
+		Tag  string `json:"tag"`
+	} `json:"registry"`
+}
+
+type gitlabProvider struct{}
+
+func (gitlabProvider) Match(headers http.Header, body []byte) bool {
+	if headers.Get("X-Gitlab-Event") != "" && !strings.Contains(headers.Get("X-Gitlab-Event"), "Container Registry") {
+		return false
+	}
+	return hasKeys(body, "object_kind", "registry")
+}
+
+func (gitlabProvider) Parse(body []byte) (interface{}, string, error) {
+	var d GitLabContainerRegistryWebhook
+	if err := json.Unmarshal(body, &d); err != nil {
+		return nil, "", err
+	}
+	return d, "gitlab", nil
+}
+
+func (gitlabProvider) Image(v interface{}) (repo, tag string, err error) {
+	d, ok := v.(GitLabContainerRegistryWebhook)
+	if !ok {
+		return "", "", fmt.Errorf("not a gitlab container registry webhook")
+	}
+	return d.Registry.Path, d.Registry.Tag, nil
+}
+
+// HarborWebhook is the payload Harbor sends for its "PUSH_ARTIFACT" event.
+type HarborWebhook struct {
+	Type      string `json:"type"`
+	OccurAt   int64  `json:"occur_at"`
+	Operator  string `json:"operator"`
+	EventData struct {
+		Resources []struct {
+			Digest      string `json:"digest"`
+			Tag         string `json:"tag"`
+			ResourceURL string `json:"resource_url"`
+		} `json:"resources"`
+		Repository struct {
+			Name         string `json:"name"`
+			Namespace    string `json:"namespace"`
+			RepoFullName string `json:"repo_full_name"`
+		} `json:"repository"`
+	} `json:"event_data"`
+}
+
+type harborProvider struct{}
+
+func (harborProvider) Match(headers http.Header, body []byte) bool {
+	return hasKeys(body, "type", "event_data", "operator")
+}
+
+func (harborProvider) Parse(body []byte) (interface{}, string, error) {
+	var d HarborWebhook
+	if err := json.Unmarshal(body, &d); err != nil {
+		return nil, "", err
+	}
+	if d.Type != "PUSH_ARTIFACT" {
+		return nil, "", fmt.Errorf("unsupported harbor event %q", d.Type)
+	}
+	return d, "harbor", nil
+}
+
+func (harborProvider) Image(v interface{}) (repo, tag string, err error) {
+	d, ok := v.(HarborWebhook)
+	if !ok {
+		return "", "", fmt.Errorf("not a harbor webhook")
+	}
+	if len(d.EventData.Resources) == 0 {
+		return d.EventData.Repository.RepoFullName, "", nil
+	}
+	return d.EventData.Repository.RepoFullName, d.EventData.Resources[0].Tag, nil
+}
+
+// GenericWebhook is the fallback `{"image":"...", "tag":"..."}` payload for
+// sources with no dedicated provider.
+type GenericWebhook struct {
+	Image string `json:"image"`
+	Tag   string `json:"tag"`
+}
+
+type genericProvider struct{}
+
+func (genericProvider) Match(headers http.Header, body []byte) bool {
+	return hasKeys(body, "image")
+}
+
+func (genericProvider) Parse(body []byte) (interface{}, string, error) {
+	var d GenericWebhook
+	if err := json.Unmarshal(body, &d); err != nil {
+		return nil, "", err
+	}
+	return d, "generic", nil
+}
+
+func (genericProvider) Image(v interface{}) (repo, tag string, err error) {
+	d, ok := v.(GenericWebhook)
+	if !ok {
+		return "", "", fmt.Errorf("not a generic webhook")
+	}
+	repo, tag = d.Image, d.Tag
+	if tag == "" {
+		repo, tag = splitImage(d.Image)
+	}
+	return repo, tag, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"testing"
+)
+
+func TestSplitImage(t *testing.T) {
+	cases := []struct {
+		image    string
+		wantRepo string
+		wantTag  string
+	}{
+		{"quay.io/coreos/krud:v1.2.3", "quay.io/coreos/krud", "v1.2.3"},
+		{"quay.io/coreos/krud", "quay.io/coreos/krud", ""},
+		{"localhost:5000/krud", "localhost:5000/krud", ""},
+		{"localhost:5000/krud:latest", "localhost:5000/krud", "latest"},
+	}
+	for _, c := range cases {
+		repo, tag := splitImage(c.image)
+		if repo != c.wantRepo || tag != c.wantTag {
+			t.Errorf("splitImage(%q) = (%q, %q), want (%q, %q)", c.image, repo, tag, c.wantRepo, c.wantTag)
+		}
+	}
+}
+
+func TestGithubProviderMatch(t *testing.T) {
+	body := []byte(`{"action":"published","package":{}}`)
+	headers := http.Header{"X-Github-Event": []string{"package"}}
+	if !(githubProvider{}).Match(headers, body) {
+		t.Fatal("expected githubProvider to match a package event")
+	}
+	if (githubProvider{}).Match(http.Header{}, body) {
+		t.Fatal("expected githubProvider to reject a request missing X-GitHub-Event")
+	}
+}
+
+func TestGithubProviderImage(t *testing.T) {
+	d := GithubPackageWebhook{}
+	d.Repository.FullName = "coreos/krud"
+	d.Package.PackageVersion.ContainerMetadata.Tag.Name = "v1.2.3"
+	repo, tag, err := (githubProvider{}).Image(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repo != "coreos/krud" || tag != "v1.2.3" {
+		t.Errorf("Image() = (%q, %q), want (%q, %q)", repo, tag, "coreos/krud", "v1.2.3")
+	}
+}
+
+func TestGitlabProviderMatch(t *testing.T) {
+	body := []byte(`{"object_kind":"container_registry","registry":{"path":"coreos/krud","tag":"v1"}}`)
+	headers := http.Header{"X-Gitlab-Event": []string{"Container Registry Hook"}}
+	if !(gitlabProvider{}).Match(headers, body) {
+		t.Fatal("expected gitlabProvider to match a Container Registry event")
+	}
+	other := http.Header{"X-Gitlab-Event": []string{"Push Hook"}}
+	if (gitlabProvider{}).Match(other, body) {
+		t.Fatal("expected gitlabProvider to reject an unrelated gitlab event")
+	}
+}
+
+func TestHarborProviderParseRejectsOtherEvents(t *testing.T) {
+	body := []byte(`{"type":"DELETE_ARTIFACT","event_data":{},"operator":"admin"}`)
+	if _, _, err := (harborProvider{}).Parse(body); err == nil {
+		t.Fatal("expected harborProvider.Parse to reject a non-PUSH_ARTIFACT event")
+	}
+}
+
+func TestVerifyGithubSignature(t *testing.T) {
+	body := []byte(`{"action":"published"}`)
+	secret := "s3cr3t"
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	header := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	if !verifyGithubSignature(body, secret, header) {
+		t.Fatal("expected a correctly signed body to verify")
+	}
+	if verifyGithubSignature(body, secret, "sha256=deadbeef") {
+		t.Fatal("expected a mismatched signature to fail verification")
+	}
+	if verifyGithubSignature(body, "wrong-secret", header) {
+		t.Fatal("expected verification to fail under the wrong secret")
+	}
+	if verifyGithubSignature(body, secret, header[len("sha256="):]) {
+		t.Fatal("expected a header missing the sha256= prefix to fail verification")
+	}
+}